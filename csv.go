@@ -7,9 +7,15 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
+	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 )
 
 type selector interface {
@@ -24,35 +30,145 @@ func parseSelector(str string) (selector, bool) {
 	}
 
 	if len(tokens) == 1 {
-		col, err := strconv.Atoi(tokens[0])
-		if err != nil {
+		if col, err := strconv.Atoi(tokens[0]); err == nil {
+			return singleColumn{column: col - 1}, true
+		}
+
+		if len(tokens[0]) == 0 {
 			return nil, false
 		}
 
-		return singleColumn{column: col - 1}, true
+		return &namedColumn{name: tokens[0], column: -1}, true
 	}
 
 	if len(tokens) == 2 {
-		start, err := strconv.Atoi(tokens[0])
-		if err != nil {
-			return nil, false
-		}
+		if start, err := strconv.Atoi(tokens[0]); err == nil {
+			if len(tokens[1]) == 0 {
+				return fromColumn{column: start - 1}, true
+			}
 
-		if len(tokens[1]) == 0 {
-			return fromColumn{column: start - 1}, true
+			stop, err := strconv.Atoi(tokens[1])
+			if err != nil {
+				return nil, false
+			}
+
+			return columnRange{start: start - 1, stop: stop - 1}, true
 		}
 
-		stop, err := strconv.Atoi(tokens[1])
-		if err != nil {
+		if len(tokens[0]) == 0 || len(tokens[1]) == 0 {
 			return nil, false
 		}
 
-		return columnRange{start: start - 1, stop: stop - 1}, true
+		return &namedRange{whole: str, fromName: tokens[0], toName: tokens[1], column: -1, start: -1, stop: -1}, true
 	}
 
 	return nil, false
 }
 
+// resolvable is implemented by selectors that reference columns by header
+// name rather than by index. resolve is called once, against the first row
+// read from the input, before any row is chosen from.
+type resolvable interface {
+	resolve(header []string) error
+}
+
+// resolveSelectors resolves every named selector in sels against header,
+// returning an error that lists the available headers on the first unknown
+// name.
+func resolveSelectors(sels []selector, header []string) error {
+	for _, sel := range sels {
+		if r, ok := sel.(resolvable); ok {
+			if err := r.resolve(header); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// requireHeader fails fast with a consistent error when a column is
+// referenced by name but -H/--has-header was not given, instead of letting
+// the name silently fail to resolve once rows start streaming.
+func requireHeader(hasHeader bool, flagName, arg string) {
+	if !hasHeader {
+		log.Fatalf("%s %q: column names require -H/--has-header", flagName, arg)
+	}
+}
+
+func requireHeaderForSelector(hasHeader bool, arg string, sel selector) {
+	if _, named := sel.(resolvable); named {
+		requireHeader(hasHeader, "-c", arg)
+	}
+}
+
+func headerIndex(header []string, name string) int {
+	for i, h := range header {
+		if h == name {
+			return i
+		}
+	}
+	return -1
+}
+
+type namedColumn struct {
+	name   string
+	column int
+}
+
+func (c *namedColumn) resolve(header []string) error {
+	idx := headerIndex(header, c.name)
+	if idx < 0 {
+		return fmt.Errorf("unknown column %q (available: %s)", c.name, strings.Join(header, ", "))
+	}
+
+	c.column = idx
+	return nil
+}
+
+func (c *namedColumn) choose(cols []string) []string {
+	if c.column < 0 {
+		return []string{}
+	}
+	return singleColumn{column: c.column}.choose(cols)
+}
+
+// namedRange selects either a single column named whole, or, when no header
+// matches whole exactly, the range of columns from fromName to toName. This
+// lets a hyphenated header name (e.g. "first-name") win over the range
+// reading of a token like "first-name" that could also be split in two.
+type namedRange struct {
+	whole            string
+	fromName, toName string
+	column           int
+	start, stop      int
+}
+
+func (c *namedRange) resolve(header []string) error {
+	if idx := headerIndex(header, c.whole); idx >= 0 {
+		c.column = idx
+		return nil
+	}
+
+	start := headerIndex(header, c.fromName)
+	stop := headerIndex(header, c.toName)
+	if start >= 0 && stop >= 0 {
+		c.start, c.stop = start, stop
+		return nil
+	}
+
+	return fmt.Errorf("unknown column %q (available: %s)", c.whole, strings.Join(header, ", "))
+}
+
+func (c *namedRange) choose(cols []string) []string {
+	if c.column >= 0 {
+		return singleColumn{column: c.column}.choose(cols)
+	}
+	if c.start >= 0 && c.stop >= 0 {
+		return columnRange{start: c.start, stop: c.stop}.choose(cols)
+	}
+	return []string{}
+}
+
 type singleColumn struct {
 	column int
 }
@@ -110,12 +226,561 @@ func (c columnRange) choose(cols []string) []string {
 	return result
 }
 
+// predicate implements a -where expression: a row passes when the value at
+// column either equals value (op '=') or matches re (op '~').
+type predicate struct {
+	colName string
+	column  int
+	op      byte
+	value   string
+	re      *regexp.Regexp
+}
+
+func parsePredicate(str string) (*predicate, error) {
+	idx := strings.IndexAny(str, "=~")
+	if idx <= 0 {
+		return nil, fmt.Errorf("bad -where expression (want col=value or col~regex): %s", str)
+	}
+
+	col, op, value := str[:idx], str[idx], str[idx+1:]
+
+	p := &predicate{op: op, value: value, column: -1}
+
+	if n, err := strconv.Atoi(col); err == nil {
+		p.column = n - 1
+	} else {
+		p.colName = col
+	}
+
+	if op == '~' {
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, fmt.Errorf("bad -where regex %q: %w", value, err)
+		}
+		p.re = re
+	}
+
+	return p, nil
+}
+
+func (p *predicate) resolve(header []string) error {
+	if p.colName == "" {
+		return nil
+	}
+
+	idx := headerIndex(header, p.colName)
+	if idx < 0 {
+		return fmt.Errorf("unknown column %q (available: %s)", p.colName, strings.Join(header, ", "))
+	}
+
+	p.column = idx
+	return nil
+}
+
+func (p *predicate) match(row []string) bool {
+	value := ""
+	if p.column >= 0 && p.column < len(row) {
+		value = row[p.column]
+	}
+
+	if p.op == '~' {
+		return p.re.MatchString(value)
+	}
+
+	return value == p.value
+}
+
+func requireHeaderForPredicate(hasHeader bool, arg string, pred *predicate) {
+	if pred.colName != "" {
+		requireHeader(hasHeader, "-where", arg)
+	}
+}
+
+func resolvePredicates(preds []*predicate, header []string) error {
+	for _, p := range preds {
+		if err := p.resolve(header); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func matchesAll(preds []*predicate, row []string) bool {
+	for _, p := range preds {
+		if !p.match(row) {
+			return false
+		}
+	}
+	return true
+}
+
+// colRef addresses a column by 1-based index or, lazily, by header name used
+// in -agg and -group-by expressions.
+type colRef struct {
+	text   string
+	column int
+}
+
+func parseColRef(text string) colRef {
+	if n, err := strconv.Atoi(text); err == nil {
+		return colRef{text: text, column: n - 1}
+	}
+	return colRef{text: text, column: -1}
+}
+
+func (c *colRef) resolve(header []string) error {
+	if c.column >= 0 {
+		return nil
+	}
+
+	idx := headerIndex(header, c.text)
+	if idx < 0 {
+		return fmt.Errorf("unknown column %q (available: %s)", c.text, strings.Join(header, ", "))
+	}
+
+	c.column = idx
+	return nil
+}
+
+func requireHeaderForColRef(hasHeader bool, flagName string, ref colRef) {
+	if ref.column < 0 {
+		requireHeader(hasHeader, flagName, ref.text)
+	}
+}
+
+func (c colRef) value(row []string) string {
+	if c.column >= 0 && c.column < len(row) {
+		return row[c.column]
+	}
+	return ""
+}
+
+// statSpec is one requested aggregate, e.g. "mean" or "p95" (kind
+// "quantile" with p=0.95).
+type statSpec struct {
+	label string
+	kind  string
+	p     float64
+}
+
+func parseStatSpec(tok string) (statSpec, error) {
+	switch tok {
+	case "count", "sum", "min", "max", "mean", "stddev":
+		return statSpec{label: tok, kind: tok}, nil
+	case "median":
+		return statSpec{label: tok, kind: "quantile", p: 0.5}, nil
+	}
+
+	if len(tok) > 1 && tok[0] == 'p' {
+		if pct, err := strconv.ParseFloat(tok[1:], 64); err == nil && pct > 0 && pct < 100 {
+			return statSpec{label: tok, kind: "quantile", p: pct / 100}, nil
+		}
+	}
+
+	return statSpec{}, fmt.Errorf("unknown -agg stat %q", tok)
+}
+
+// aggColSpec is one column of a -agg expression together with the stats
+// requested for it, e.g. "latency:p50,p95,p99".
+type aggColSpec struct {
+	ref   colRef
+	stats []statSpec
+}
+
+// parseAggSpec parses a -agg expression such as
+// "price:mean,latency:p50,p95,p99". A token without a "col:" prefix applies
+// an additional stat to the most recently named column.
+func parseAggSpec(str string) ([]*aggColSpec, error) {
+	var specs []*aggColSpec
+	var cur *aggColSpec
+
+	for _, tok := range strings.Split(str, ",") {
+		tok = strings.TrimSpace(tok)
+		if tok == "" {
+			continue
+		}
+
+		if idx := strings.Index(tok, ":"); idx >= 0 {
+			cur = &aggColSpec{ref: parseColRef(tok[:idx])}
+			specs = append(specs, cur)
+			tok = tok[idx+1:]
+		} else if cur == nil {
+			return nil, fmt.Errorf("bad -agg expression (stat %q has no column): %s", tok, str)
+		}
+
+		stat, err := parseStatSpec(tok)
+		if err != nil {
+			return nil, err
+		}
+
+		cur.stats = append(cur.stats, stat)
+	}
+
+	return specs, nil
+}
+
+// p2Estimator estimates the p-quantile of a stream in O(1) space using the
+// P² algorithm (Jain & Chlamtac, 1985): five markers track the curve's
+// shape and are repositioned, parabolically or linearly, as each new
+// observation arrives.
+type p2Estimator struct {
+	p       float64
+	count   int
+	initial []float64
+	q       [5]float64
+	n       [5]int
+	np      [5]float64
+	dn      [5]float64
+}
+
+func newP2Estimator(p float64) *p2Estimator {
+	return &p2Estimator{p: p}
+}
+
+func (e *p2Estimator) add(x float64) {
+	e.count++
+
+	if len(e.initial) < 5 {
+		e.initial = append(e.initial, x)
+		if len(e.initial) == 5 {
+			sort.Float64s(e.initial)
+			for i := 0; i < 5; i++ {
+				e.q[i] = e.initial[i]
+				e.n[i] = i + 1
+			}
+			e.np = [5]float64{1, 1 + 2*e.p, 1 + 4*e.p, 3 + 2*e.p, 5}
+			e.dn = [5]float64{0, e.p / 2, e.p, (1 + e.p) / 2, 1}
+		}
+		return
+	}
+
+	k := 0
+	switch {
+	case x < e.q[0]:
+		e.q[0] = x
+	case x >= e.q[4]:
+		e.q[4] = x
+		k = 3
+	default:
+		for i := 0; i < 4; i++ {
+			if x < e.q[i+1] {
+				k = i
+				break
+			}
+		}
+	}
+
+	for i := k + 1; i < 5; i++ {
+		e.n[i]++
+	}
+	for i := 0; i < 5; i++ {
+		e.np[i] += e.dn[i]
+	}
+
+	for i := 1; i < 4; i++ {
+		d := e.np[i] - float64(e.n[i])
+
+		if d >= 1 && e.n[i+1]-e.n[i] > 1 {
+			e.adjust(i, 1)
+		} else if d <= -1 && e.n[i-1]-e.n[i] < -1 {
+			e.adjust(i, -1)
+		}
+	}
+}
+
+func (e *p2Estimator) adjust(i, d int) {
+	qNew := e.parabolic(i, float64(d))
+	if e.q[i-1] < qNew && qNew < e.q[i+1] {
+		e.q[i] = qNew
+	} else {
+		e.q[i] = e.linear(i, d)
+	}
+	e.n[i] += d
+}
+
+func (e *p2Estimator) parabolic(i int, d float64) float64 {
+	return e.q[i] + d/float64(e.n[i+1]-e.n[i-1])*
+		((float64(e.n[i]-e.n[i-1])+d)*(e.q[i+1]-e.q[i])/float64(e.n[i+1]-e.n[i])+
+			(float64(e.n[i+1]-e.n[i])-d)*(e.q[i]-e.q[i-1])/float64(e.n[i]-e.n[i-1]))
+}
+
+func (e *p2Estimator) linear(i, d int) float64 {
+	return e.q[i] + float64(d)*(e.q[i+d]-e.q[i])/float64(e.n[i+d]-e.n[i])
+}
+
+func (e *p2Estimator) value() float64 {
+	if e.count == 0 {
+		return 0
+	}
+	if e.count < 5 {
+		sorted := append([]float64(nil), e.initial...)
+		sort.Float64s(sorted)
+		return sorted[int(e.p*float64(len(sorted)-1))]
+	}
+	return e.q[2]
+}
+
+// aggState accumulates count/sum/min/max/mean/stddev (via Welford's online
+// algorithm) and any requested quantiles for a single column.
+type aggState struct {
+	count      int64
+	sum        float64
+	min, max   float64
+	haveMinMax bool
+	mean, m2   float64
+	quantiles  map[float64]*p2Estimator
+}
+
+func newAggState() *aggState {
+	return &aggState{quantiles: map[float64]*p2Estimator{}}
+}
+
+func (a *aggState) quantile(p float64) *p2Estimator {
+	q, ok := a.quantiles[p]
+	if !ok {
+		q = newP2Estimator(p)
+		a.quantiles[p] = q
+	}
+	return q
+}
+
+func (a *aggState) add(x float64) {
+	a.count++
+	a.sum += x
+
+	if !a.haveMinMax {
+		a.min, a.max = x, x
+		a.haveMinMax = true
+	} else if x < a.min {
+		a.min = x
+	} else if x > a.max {
+		a.max = x
+	}
+
+	delta := x - a.mean
+	a.mean += delta / float64(a.count)
+	a.m2 += delta * (x - a.mean)
+
+	for _, q := range a.quantiles {
+		q.add(x)
+	}
+}
+
+func (a *aggState) variance() float64 {
+	if a.count < 2 {
+		return 0
+	}
+	return a.m2 / float64(a.count-1)
+}
+
+func formatAggFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func (a *aggState) value(stat statSpec) string {
+	switch stat.kind {
+	case "count":
+		return strconv.FormatInt(a.count, 10)
+	case "sum":
+		return formatAggFloat(a.sum)
+	case "min":
+		if !a.haveMinMax {
+			return ""
+		}
+		return formatAggFloat(a.min)
+	case "max":
+		if !a.haveMinMax {
+			return ""
+		}
+		return formatAggFloat(a.max)
+	case "mean":
+		if a.count == 0 {
+			return ""
+		}
+		return formatAggFloat(a.mean)
+	case "stddev":
+		if a.count < 2 {
+			return ""
+		}
+		return formatAggFloat(math.Sqrt(a.variance()))
+	case "quantile":
+		if a.count == 0 {
+			return ""
+		}
+		return formatAggFloat(a.quantile(stat.p).value())
+	}
+	return ""
+}
+
+// runAgg computes the aggregates described by specs over r, grouping by
+// groupBy if non-nil, and writes a header row followed by one summary row
+// per group (a single row when groupBy is nil).
+func runAgg(r csv.Reader, write func([]string), specs []*aggColSpec, groupBy *colRef, hasHeader bool, predicates []*predicate, from, to int) {
+	headerRow := []string{}
+	if groupBy != nil {
+		headerRow = append(headerRow, groupBy.text)
+	}
+	for _, spec := range specs {
+		for _, stat := range spec.stats {
+			headerRow = append(headerRow, spec.ref.text+"_"+stat.label)
+		}
+	}
+	write(headerRow)
+
+	groups := map[string][]*aggState{}
+	var order []string
+
+	ensureGroup := func(key string) []*aggState {
+		states, ok := groups[key]
+		if ok {
+			return states
+		}
+
+		states = make([]*aggState, len(specs))
+		for i, spec := range specs {
+			st := newAggState()
+			for _, stat := range spec.stats {
+				if stat.kind == "quantile" {
+					st.quantile(stat.p)
+				}
+			}
+			states[i] = st
+		}
+
+		groups[key] = states
+		order = append(order, key)
+		return states
+	}
+
+	first := true
+	rowNum := 0
+
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Fatal(err)
+		}
+
+		if first {
+			first = false
+
+			if header, _ := consumeHeader(row, hasHeader, false); header != nil {
+				for _, spec := range specs {
+					if err := spec.ref.resolve(header); err != nil {
+						log.Fatal(err)
+					}
+				}
+
+				if groupBy != nil {
+					if err := groupBy.resolve(header); err != nil {
+						log.Fatal(err)
+					}
+				}
+
+				if err := resolvePredicates(predicates, header); err != nil {
+					log.Fatal(err)
+				}
+
+				continue
+			}
+		}
+
+		rowNum++
+
+		proceed, stop := inRange(rowNum, from, to)
+		if stop {
+			break
+		}
+		if !proceed || !matchesAll(predicates, row) {
+			continue
+		}
+
+		key := ""
+		if groupBy != nil {
+			key = groupBy.value(row)
+		}
+
+		states := ensureGroup(key)
+
+		for i, spec := range specs {
+			x, err := strconv.ParseFloat(strings.TrimSpace(spec.ref.value(row)), 64)
+			if err != nil {
+				continue
+			}
+			states[i].add(x)
+		}
+	}
+
+	if groupBy == nil {
+		ensureGroup("")
+	}
+
+	for _, key := range order {
+		states := groups[key]
+
+		outRow := []string{}
+		if groupBy != nil {
+			outRow = append(outRow, key)
+		}
+
+		for i, spec := range specs {
+			for _, stat := range spec.stats {
+				outRow = append(outRow, states[i].value(stat))
+			}
+		}
+
+		write(outRow)
+	}
+}
+
+// stringList accumulates repeated occurrences of a flag, e.g. -where a=1
+// -where b=2.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
 type options struct {
-	selectors []selector
-	printToc  bool
-	squash    bool
-	tsv       bool
-	raw       bool
+	selectors  []selector
+	predicates []*predicate
+	from, to   int
+	printToc   bool
+	squash     bool
+	tsv        bool
+	raw        bool
+	hasHeader  bool
+	noHeader   bool
+	format     string
+
+	inDelim           string
+	inComment         string
+	inLazyQuotes      bool
+	inFieldsPerRecord int
+
+	workers int
+
+	aggSpec string
+	groupBy string
+}
+
+// defaultWorkers picks the default -j value: one worker per CPU when stdin
+// is a regular file, since row processing is then the bottleneck, or a
+// single worker when it's a pipe, since rows then arrive only as fast as
+// their producer anyway.
+func defaultWorkers() int {
+	info, err := os.Stdin.Stat()
+	if err == nil && info.Mode().IsRegular() {
+		return runtime.NumCPU()
+	}
+	return 1
 }
 
 func initOptions() options {
@@ -124,6 +789,21 @@ func initOptions() options {
 	squash := flag.Bool("trim", false, "Trim rows that have no data to output")
 	tsv := flag.Bool("tsv", false, "Output in tsv format")
 	raw := flag.Bool("raw", false, "Output raw data")
+	hasHeader := flag.Bool("H", false, "Treat the first row as a header, allowing -c to reference columns by name")
+	flag.BoolVar(hasHeader, "has-header", false, "Same as -H")
+	noHeader := flag.Bool("no-header", false, "Drop the header row from the output instead of echoing it (implies -H)")
+	format := flag.String("fmt", "", "Render each row with a text/template string, e.g. '{{.name}} <{{.email}}>' (fields by header name with -H, or {{index . 0}} by position)")
+	from := flag.Int("from", 0, "First data row to include (1-based, inclusive)")
+	to := flag.Int("to", 0, "Last data row to include (1-based, inclusive); stops reading once reached")
+	var where stringList
+	flag.Var(&where, "where", "Filter rows where col=value or col~regex, referencing columns by header name or 1-based index (repeatable, AND-combined)")
+	inDelim := flag.String("in-delim", "", `Input field delimiter: a single character, or "auto" to sniff ,/tab/;/| from the first few lines (default ",")`)
+	inComment := flag.String("in-comment", "", "Input comment character; lines beginning with it are skipped")
+	inLazyQuotes := flag.Bool("in-lazy-quotes", false, "Allow lazy handling of quotes in the input")
+	inFieldsPerRecord := flag.Int("in-fields-per-record", 0, "Expected number of fields per input record (0 = infer from the first row, negative = no check)")
+	workers := flag.Int("j", defaultWorkers(), "Number of worker goroutines for row processing")
+	agg := flag.String("agg", "", "Compute aggregates instead of projecting rows, e.g. 'price:mean,latency:p50,p95,p99' (columns by header name or 1-based index)")
+	groupBy := flag.String("group-by", "", "With -agg, emit one summary row per distinct value of this column (name or 1-based index) instead of a single row")
 
 	flag.Parse()
 
@@ -131,21 +811,64 @@ func initOptions() options {
 
 	opts := options{}
 
+	opts.printToc = *printToc
+	opts.squash = *squash
+	opts.tsv = *tsv
+	opts.raw = *raw
+	opts.noHeader = *noHeader
+	opts.hasHeader = *hasHeader || *noHeader
+	opts.format = *format
+	opts.from = *from
+	opts.to = *to
+
 	if len(*splice) > 0 {
 		for _, arg := range strings.Split(*splice, ",") {
-			if sel, ok := parseSelector(arg); ok {
-				opts.selectors = append(opts.selectors, sel)
-				continue
+			sel, ok := parseSelector(arg)
+			if !ok {
+				log.Fatalf("Bad selector: %s\n", arg)
 			}
 
-			log.Fatalf("Bad selector: %s\n", arg)
+			requireHeaderForSelector(opts.hasHeader, arg, sel)
+			opts.selectors = append(opts.selectors, sel)
 		}
 	}
 
-	opts.printToc = *printToc
-	opts.squash = *squash
-	opts.tsv = *tsv
-	opts.raw = *raw
+	for _, arg := range where {
+		pred, err := parsePredicate(arg)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		requireHeaderForPredicate(opts.hasHeader, arg, pred)
+		opts.predicates = append(opts.predicates, pred)
+	}
+
+	opts.inDelim = *inDelim
+	opts.inComment = *inComment
+	opts.inLazyQuotes = *inLazyQuotes
+	opts.inFieldsPerRecord = *inFieldsPerRecord
+
+	opts.workers = *workers
+	if opts.workers < 1 {
+		opts.workers = 1
+	}
+
+	opts.aggSpec = *agg
+	opts.groupBy = *groupBy
+
+	if opts.aggSpec != "" {
+		specs, err := parseAggSpec(opts.aggSpec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, spec := range specs {
+			requireHeaderForColRef(opts.hasHeader, "-agg", spec.ref)
+		}
+	}
+
+	if opts.groupBy != "" {
+		requireHeaderForColRef(opts.hasHeader, "-group-by", parseColRef(opts.groupBy))
+	}
 
 	if len(opts.selectors) == 0 {
 		opts.selectors = append(opts.selectors, fromColumn{0})
@@ -154,7 +877,131 @@ func initOptions() options {
 	return opts
 }
 
-func dumpRows(r csv.Reader, write func([]string), selectors []selector, squash bool) {
+// consumeHeader reports whether row (the first row read from the input) is
+// the header row, and whether it should be skipped rather than treated as a
+// normal data row.
+func consumeHeader(row []string, hasHeader, noHeader bool) (header []string, skip bool) {
+	if !hasHeader {
+		return nil, false
+	}
+	return row, noHeader
+}
+
+// inRange applies the shared -from/-to windowing to a 1-based data row
+// number, reporting whether the row should be processed and whether the
+// caller can stop reading altogether (rowNum is past -to).
+func inRange(rowNum, from, to int) (proceed bool, stop bool) {
+	if to > 0 && rowNum > to {
+		return false, true
+	}
+	if from > 0 && rowNum < from {
+		return false, false
+	}
+	return true, false
+}
+
+// projectRow applies selectors to row and reports whether the result should
+// be written, honoring squash (omit rows whose projection has no data).
+func projectRow(row []string, selectors []selector, squash bool) ([]string, bool) {
+	outRow := []string{}
+	for _, sel := range selectors {
+		outRow = append(outRow, sel.choose(row)...)
+	}
+
+	if len(outRow) == 0 {
+		return nil, false
+	}
+
+	if squash {
+		hasData := false
+		for _, v := range outRow {
+			if len(v) > 0 {
+				hasData = true
+				break
+			}
+		}
+		if !hasData {
+			return nil, false
+		}
+	}
+
+	return outRow, true
+}
+
+type rowJob struct {
+	seq       int
+	row       []string
+	headerJob bool // header row: bypass from/to/predicate filtering
+}
+
+type rowResult struct {
+	seq int
+	row []string
+	ok  bool
+}
+
+// dumpRows streams rows from r through a producer/worker/writer pipeline:
+// this goroutine reads rows and dispatches them to workers, workers apply
+// predicates and selectors in parallel, and a single writer goroutine emits
+// results in the original row order via a sequence-numbered reorder buffer.
+func dumpRows(r csv.Reader, write func([]string), selectors []selector, predicates []*predicate, squash bool, hasHeader bool, noHeader bool, from, to, workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan rowJob, workers*2)
+	results := make(chan rowResult, workers*2)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if !j.headerJob && !matchesAll(predicates, j.row) {
+					results <- rowResult{seq: j.seq}
+					continue
+				}
+
+				outRow, ok := projectRow(j.row, selectors, squash)
+				results <- rowResult{seq: j.seq, row: outRow, ok: ok}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		pending := map[int]rowResult{}
+		next := 0
+
+		for res := range results {
+			pending[res.seq] = res
+
+			for {
+				res, ok := pending[next]
+				if !ok {
+					break
+				}
+				delete(pending, next)
+
+				if res.ok {
+					write(res.row)
+				}
+				next++
+			}
+		}
+	}()
+
+	first := true
+	rowNum := 0
+	seq := 0
+
 	for {
 		row, err := r.Read()
 		if err == io.EOF {
@@ -163,25 +1010,125 @@ func dumpRows(r csv.Reader, write func([]string), selectors []selector, squash b
 			log.Fatal(err)
 		}
 
-		outRow := []string{}
-		for _, sel := range selectors {
-			outRow = append(outRow, sel.choose(row)...)
+		if first {
+			first = false
+
+			if header, skip := consumeHeader(row, hasHeader, noHeader); header != nil {
+				if err := resolveSelectors(selectors, header); err != nil {
+					log.Fatal(err)
+				}
+
+				if err := resolvePredicates(predicates, header); err != nil {
+					log.Fatal(err)
+				}
+
+				if !skip {
+					jobs <- rowJob{seq: seq, row: row, headerJob: true}
+					seq++
+				}
+
+				continue
+			}
 		}
 
-		// When `squash` is true, we want to omit any rows that have no data.
+		rowNum++
 
-		for _, v := range outRow {
+		proceed, stop := inRange(rowNum, from, to)
+		if stop {
+			break
+		}
+		if !proceed {
+			continue
+		}
+
+		jobs <- rowJob{seq: seq, row: row}
+		seq++
+	}
+
+	close(jobs)
+	<-done
+}
+
+// rowMap maps a data row into a map[string]string keyed by header name, for
+// use as the data value of a -fmt template.
+func rowMap(header, row []string) map[string]string {
+	m := make(map[string]string, len(header))
+	for i, h := range header {
+		if i < len(row) {
+			m[h] = row[i]
+		}
+	}
+	return m
+}
+
+// dumpTemplate renders each row of r through tmpl. When hasHeader is set,
+// fields are addressed by header name (e.g. {{.name}}); otherwise tmpl falls
+// back to positional access via {{index . 0}}. Data rows are subject to the
+// same -from/-to/-where filtering as dumpRows.
+func dumpTemplate(r csv.Reader, w io.Writer, tmpl *template.Template, hasHeader bool, noHeader bool, predicates []*predicate, from, to int) {
+	var header []string
+	first := true
+	rowNum := 0
+
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Fatal(err)
+		}
+
+		if first {
+			first = false
+
+			if h, skip := consumeHeader(row, hasHeader, noHeader); h != nil {
+				if err := resolvePredicates(predicates, h); err != nil {
+					log.Fatal(err)
+				}
+
+				header = h
+
+				if !skip {
+					renderRow(w, tmpl, rowTemplateData(header, row))
+				}
 
-			if len(v) == 0 && squash {
 				continue
 			}
+		}
 
-			write(outRow)
+		rowNum++
+
+		proceed, stop := inRange(rowNum, from, to)
+		if stop {
 			break
 		}
+		if !proceed || !matchesAll(predicates, row) {
+			continue
+		}
+
+		renderRow(w, tmpl, rowTemplateData(header, row))
 	}
 }
 
+// renderRow executes tmpl against data and writes the result to w followed
+// by a newline.
+func renderRow(w io.Writer, tmpl *template.Template, data interface{}) {
+	if err := tmpl.Execute(w, data); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Fprintln(w)
+}
+
+// rowTemplateData returns the template data for row: a map keyed by header
+// name when header is available, or row itself for positional access.
+func rowTemplateData(header, row []string) interface{} {
+	if header != nil {
+		return rowMap(header, row)
+	}
+	return row
+}
+
 func printToc(r csv.Reader) {
 	header, err := r.Read()
 	if err != nil {
@@ -193,43 +1140,164 @@ func printToc(r csv.Reader) {
 	}
 }
 
-func main() {
-	opts := initOptions()
+// delimiterCandidates are tried, in order, when sniffing an input's
+// delimiter; ties are broken by preferring more columns.
+var delimiterCandidates = []rune{',', '\t', ';', '|'}
+
+const sniffBytes = 4096
+
+// detectDelimiter peeks at the start of br (without consuming it) and picks
+// the candidate delimiter whose column count is stable across the first few
+// lines. It falls back to comma if no candidate looks stable.
+func detectDelimiter(br *bufio.Reader) rune {
+	peek, _ := br.Peek(sniffBytes)
+
+	lines := strings.Split(string(peek), "\n")
+	if len(lines) > 5 {
+		lines = lines[:5]
+	}
 
-	var outfn func([]string)
+	best := ','
+	bestFields := -1
 
+	for _, d := range delimiterCandidates {
+		fields := -1
+		stable := true
+
+		for _, line := range lines {
+			if len(line) == 0 {
+				continue
+			}
+
+			n := strings.Count(line, string(d))
+			if fields == -1 {
+				fields = n
+			} else if n != fields {
+				stable = false
+				break
+			}
+		}
+
+		if stable && fields > bestFields {
+			bestFields = fields
+			best = d
+		}
+	}
+
+	return best
+}
+
+// newReader builds a csv.Reader over in, configured from the -in-* options.
+func newReader(opts options, in io.Reader) *csv.Reader {
+	br := bufio.NewReader(in)
+	r := csv.NewReader(br)
+
+	switch opts.inDelim {
+	case "", ",":
+		// keep the default comma
+	case "auto":
+		r.Comma = detectDelimiter(br)
+	default:
+		runes := []rune(opts.inDelim)
+		if len(runes) != 1 {
+			log.Fatalf("-in-delim must be a single character (or \"auto\"): %q", opts.inDelim)
+		}
+		r.Comma = runes[0]
+	}
+
+	if opts.inComment != "" {
+		runes := []rune(opts.inComment)
+		if len(runes) != 1 {
+			log.Fatalf("-in-comment must be a single character: %q", opts.inComment)
+		}
+		r.Comment = runes[0]
+	}
+
+	r.LazyQuotes = opts.inLazyQuotes
+
+	if opts.inFieldsPerRecord != 0 {
+		r.FieldsPerRecord = opts.inFieldsPerRecord
+	}
+
+	return r
+}
+
+// newWriter builds the row-writing function for the output mode selected by
+// opts (raw, tsv, or csv), along with a flush function the caller must run
+// once all rows have been written.
+func newWriter(opts options) (write func([]string), flush func() error) {
 	if opts.raw {
 		writer := bufio.NewWriter(os.Stdout)
-		outfn = func(cols []string) {
+		return func(cols []string) {
 			for _, v := range cols {
-				_, err := writer.WriteString(v)
-				if err != nil {
+				if _, err := writer.WriteString(v); err != nil {
 					log.Fatal(err)
 				}
 			}
-			_, err := writer.WriteString("\n")
-			if err != nil {
+			if _, err := writer.WriteString("\n"); err != nil {
 				log.Fatal(err)
 			}
-		}
-	} else {
-		writer := csv.NewWriter(os.Stdout)
-		if opts.tsv {
-			writer.Comma = '\t'
-		}
-		outfn = func(cols []string) {
-			err := writer.Write(cols)
-			if err != nil {
+		}, writer.Flush
+	}
+
+	writer := csv.NewWriter(os.Stdout)
+	if opts.tsv {
+		writer.Comma = '\t'
+	}
+
+	return func(cols []string) {
+			if err := writer.Write(cols); err != nil {
 				log.Fatal(nil)
 			}
+		}, func() error {
+			writer.Flush()
+			return writer.Error()
+		}
+}
+
+func main() {
+	opts := initOptions()
+	reader := newReader(opts, os.Stdin)
+
+	if opts.aggSpec != "" {
+		specs, err := parseAggSpec(opts.aggSpec)
+		if err != nil {
+			log.Fatal(err)
 		}
+
+		var groupBy *colRef
+		if opts.groupBy != "" {
+			ref := parseColRef(opts.groupBy)
+			groupBy = &ref
+		}
+
+		outfn, flush := newWriter(opts)
+		runAgg(*reader, outfn, specs, groupBy, opts.hasHeader, opts.predicates, opts.from, opts.to)
+		if err := flush(); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	reader := csv.NewReader(os.Stdin)
+	if opts.format != "" {
+		tmpl, err := template.New("fmt").Parse(opts.format)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		dumpTemplate(*reader, os.Stdout, tmpl, opts.hasHeader, opts.noHeader, opts.predicates, opts.from, opts.to)
+		return
+	}
+
+	outfn, flush := newWriter(opts)
 
 	if opts.printToc {
 		printToc(*reader)
 	} else {
-		dumpRows(*reader, outfn, opts.selectors, opts.squash)
+		dumpRows(*reader, outfn, opts.selectors, opts.predicates, opts.squash, opts.hasHeader, opts.noHeader, opts.from, opts.to, opts.workers)
+	}
+
+	if err := flush(); err != nil {
+		log.Fatal(err)
 	}
 }
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/csv"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	header := []string{"first-name", "last", "age"}
+
+	cases := []struct {
+		name string
+		arg  string
+		row  []string
+		want []string
+	}{
+		{"numeric single", "2", []string{"a", "b", "c"}, []string{"b"}},
+		{"numeric range", "1-2", []string{"a", "b", "c"}, []string{"a", "b"}},
+		{"numeric reversed range", "2-1", []string{"a", "b", "c"}, []string{"b", "a"}},
+		{"numeric from", "2-", []string{"a", "b", "c"}, []string{"b", "c"}},
+		{"named column", "last", header, []string{"last"}},
+		{"named range", "last-age", header, []string{"last", "age"}},
+		{"hyphenated header name wins over range", "first-name", header, []string{"first-name"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sel, ok := parseSelector(c.arg)
+			if !ok {
+				t.Fatalf("parseSelector(%q) returned ok=false", c.arg)
+			}
+
+			if r, named := sel.(resolvable); named {
+				if err := r.resolve(header); err != nil {
+					t.Fatalf("resolve: %v", err)
+				}
+			}
+
+			got := sel.choose(c.row)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("parseSelector(%q).choose(%v) = %v, want %v", c.arg, c.row, got, c.want)
+			}
+		})
+	}
+}
+
+func TestParseSelectorInvalid(t *testing.T) {
+	for _, arg := range []string{"", "1-2-3", "-"} {
+		if _, ok := parseSelector(arg); ok {
+			t.Errorf("parseSelector(%q) returned ok=true, want false", arg)
+		}
+	}
+}
+
+func TestParsePredicate(t *testing.T) {
+	header := []string{"name", "age"}
+
+	cases := []struct {
+		name  string
+		arg   string
+		row   []string
+		match bool
+	}{
+		{"numeric equals", "1=Alice", []string{"Alice", "30"}, true},
+		{"numeric equals mismatch", "1=Bob", []string{"Alice", "30"}, false},
+		{"named equals", "age=30", []string{"Alice", "30"}, true},
+		{"named regex", "name~^A", []string{"Alice", "30"}, true},
+		{"named regex mismatch", "name~^B", []string{"Alice", "30"}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p, err := parsePredicate(c.arg)
+			if err != nil {
+				t.Fatalf("parsePredicate(%q): %v", c.arg, err)
+			}
+
+			if err := p.resolve(header); err != nil {
+				t.Fatalf("resolve: %v", err)
+			}
+
+			if got := p.match(c.row); got != c.match {
+				t.Errorf("parsePredicate(%q).match(%v) = %v, want %v", c.arg, c.row, got, c.match)
+			}
+		})
+	}
+}
+
+func TestParsePredicateInvalid(t *testing.T) {
+	for _, arg := range []string{"noop", "=foo", "name~("} {
+		if _, err := parsePredicate(arg); err == nil {
+			t.Errorf("parsePredicate(%q) returned nil error, want one", arg)
+		}
+	}
+}
+
+func TestParseAggSpec(t *testing.T) {
+	specs, err := parseAggSpec("price:mean,latency:p50,p95,p99")
+	if err != nil {
+		t.Fatalf("parseAggSpec: %v", err)
+	}
+
+	if len(specs) != 2 {
+		t.Fatalf("got %d specs, want 2", len(specs))
+	}
+
+	if specs[0].ref.text != "price" || len(specs[0].stats) != 1 || specs[0].stats[0].kind != "mean" {
+		t.Errorf("unexpected price spec: %+v", specs[0])
+	}
+
+	if specs[1].ref.text != "latency" || len(specs[1].stats) != 3 {
+		t.Errorf("unexpected latency spec: %+v", specs[1])
+	}
+	for _, stat := range specs[1].stats {
+		if stat.kind != "quantile" {
+			t.Errorf("stat %q: kind = %q, want quantile", stat.label, stat.kind)
+		}
+	}
+}
+
+func TestParseAggSpecInvalid(t *testing.T) {
+	for _, arg := range []string{"mean", "price:bogus", "price:p150"} {
+		if _, err := parseAggSpec(arg); err == nil {
+			t.Errorf("parseAggSpec(%q) returned nil error, want one", arg)
+		}
+	}
+}
+
+// TestRunAgg checks the Welford mean/variance, exact-path P² quantile, and
+// -group-by output against hand-computed stats for two known groups.
+func TestRunAgg(t *testing.T) {
+	input := "grp,v\n" +
+		"a,10\na,20\na,30\na,30\na,40\n" +
+		"b,5\nb,15\nb,25\n"
+
+	r := csv.NewReader(strings.NewReader(input))
+
+	specs, err := parseAggSpec("v:count,sum,min,max,mean,stddev,median")
+	if err != nil {
+		t.Fatalf("parseAggSpec: %v", err)
+	}
+	groupBy := parseColRef("grp")
+
+	var got [][]string
+	write := func(cols []string) { got = append(got, cols) }
+
+	runAgg(*r, write, specs, &groupBy, true, nil, 0, 0)
+
+	wantHeader := []string{"grp", "v_count", "v_sum", "v_min", "v_max", "v_mean", "v_stddev", "v_median"}
+
+	wantA := []string{
+		"a", "5", "130", "10", "40", "26",
+		formatAggFloat(math.Sqrt(130)), "30",
+	}
+	wantB := []string{
+		"b", "3", "45", "5", "25", "15",
+		formatAggFloat(math.Sqrt(100)), "15",
+	}
+
+	want := [][]string{wantHeader, wantA, wantB}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("runAgg output =\n%v\nwant\n%v", got, want)
+	}
+}
+
+// TestDumpRowsPreservesOrder checks that dumpRows's reorder buffer emits rows
+// in input order regardless of how many workers race to process them.
+func TestDumpRowsPreservesOrder(t *testing.T) {
+	var input strings.Builder
+	input.WriteString("n\n")
+	for i := 1; i <= 200; i++ {
+		input.WriteString(strconv.Itoa(i))
+		input.WriteByte('\n')
+	}
+
+	for _, workers := range []int{1, 4, 16} {
+		t.Run(strconv.Itoa(workers), func(t *testing.T) {
+			r := csv.NewReader(strings.NewReader(input.String()))
+
+			var mu sync.Mutex
+			var got []string
+			write := func(cols []string) {
+				mu.Lock()
+				got = append(got, cols[0])
+				mu.Unlock()
+			}
+
+			sel, _ := parseSelector("1")
+			dumpRows(*r, write, []selector{sel}, nil, false, true, true, 0, 0, workers)
+
+			if len(got) != 200 {
+				t.Fatalf("got %d rows, want 200", len(got))
+			}
+			for i, v := range got {
+				if v != strconv.Itoa(i+1) {
+					t.Fatalf("row %d = %q, want %q", i, v, strconv.Itoa(i+1))
+				}
+			}
+		})
+	}
+}